@@ -0,0 +1,131 @@
+// Copyright (c) 2019 Palantir Technologies. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	"sync"
+	"time"
+
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+)
+
+// defaultCRDCheckExpiration is how long a CachedCRDChecker trusts a cached result before hitting
+// the API server again, absent an explicit WithExpiration option or an observed CRD event.
+const defaultCRDCheckExpiration = 30 * time.Second
+
+type crdCheckResult struct {
+	exists      bool
+	established bool
+	err         error
+	lastRefresh time.Time
+}
+
+// CachedCRDChecker wraps CheckCRDExists with a TTL cache, so that repeated callers (e.g. every
+// LazyInformer polling for its own CRD, or a growing number of CRD-gated code paths) don't each
+// hit the API server independently. ForceRefresh lets a caller that has independently observed a
+// CRD create/delete event invalidate the cache immediately, rather than waiting out the TTL.
+type CachedCRDChecker struct {
+	apiExtensionsClient apiextensionsclientset.Interface
+	expiration          time.Duration
+
+	lock    sync.Mutex
+	results map[string]crdCheckResult
+}
+
+// CachedCRDCheckerOption customizes a CachedCRDChecker created via NewCachedCRDChecker.
+type CachedCRDCheckerOption func(*CachedCRDChecker)
+
+// WithExpiration overrides the default TTL a cached result is trusted for.
+func WithExpiration(expiration time.Duration) CachedCRDCheckerOption {
+	return func(c *CachedCRDChecker) {
+		c.expiration = expiration
+	}
+}
+
+// NewCachedCRDChecker returns a new CachedCRDChecker backed by apiExtensionsClient.
+func NewCachedCRDChecker(apiExtensionsClient apiextensionsclientset.Interface, opts ...CachedCRDCheckerOption) *CachedCRDChecker {
+	c := &CachedCRDChecker{
+		apiExtensionsClient: apiExtensionsClient,
+		expiration:          defaultCRDCheckExpiration,
+		results:             make(map[string]crdCheckResult),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Exists returns whether the named CRD exists and, if so, whether it is Established, serving the
+// cached result if it was refreshed within the configured expiration and hitting the API server
+// via CheckCRDExists otherwise.
+func (c *CachedCRDChecker) Exists(name string) (exists bool, established bool, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if result, ok := c.results[name]; ok && time.Since(result.lastRefresh) < c.expiration {
+		return result.exists, result.established, result.err
+	}
+	return c.refreshLocked(name)
+}
+
+// ForceRefresh invalidates any cached result for name and immediately re-queries the API server,
+// returning the fresh result. Prefer Set over ForceRefresh when the caller already knows the
+// answer first-hand (e.g. from a watch event payload) rather than needing to ask the API server
+// again for a value it already has.
+func (c *CachedCRDChecker) ForceRefresh(name string) (exists bool, established bool, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.refreshLocked(name)
+}
+
+// Set records a result in the cache without contacting the API server, for callers that already
+// know the answer first-hand (e.g. the CRD watch handler backing LazyInformer, which receives the
+// CRD object itself on every Add/Update/Delete) and just need the cache kept consistent with the
+// event stream rather than re-queried.
+func (c *CachedCRDChecker) Set(name string, exists bool, established bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.results[name] = crdCheckResult{
+		exists:      exists,
+		established: established,
+		lastRefresh: time.Now(),
+	}
+}
+
+func (c *CachedCRDChecker) refreshLocked(name string) (bool, bool, error) {
+	exists, established, err := CheckCRDExists(name, c.apiExtensionsClient)
+	c.results[name] = crdCheckResult{
+		exists:      exists,
+		established: established,
+		err:         err,
+		lastRefresh: time.Now(),
+	}
+	return exists, established, err
+}
+
+var (
+	sharedCRDCheckerLock sync.Mutex
+	sharedCRDChecker     *CachedCRDChecker
+)
+
+// SharedCRDChecker returns the process-wide CachedCRDChecker used by all lazy informers,
+// constructing it on first use.
+func SharedCRDChecker(apiExtensionsClient apiextensionsclientset.Interface) *CachedCRDChecker {
+	sharedCRDCheckerLock.Lock()
+	defer sharedCRDCheckerLock.Unlock()
+	if sharedCRDChecker == nil {
+		sharedCRDChecker = NewCachedCRDChecker(apiExtensionsClient)
+	}
+	return sharedCRDChecker
+}
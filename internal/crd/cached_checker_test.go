@@ -0,0 +1,93 @@
+// Copyright (c) 2019 Palantir Technologies. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	"testing"
+	"time"
+
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+)
+
+// TestCachedCRDCheckerSetServesWithoutQueryingAPIServer is the regression test for the watch
+// handler's use of Set: a caller that already knows the answer first-hand (e.g. from a watch
+// event payload) should be able to record it without CachedCRDChecker re-querying the API server,
+// unlike ForceRefresh.
+func TestCachedCRDCheckerSetServesWithoutQueryingAPIServer(t *testing.T) {
+	client := apiextensionsfake.NewSimpleClientset()
+	checker := NewCachedCRDChecker(client, WithExpiration(time.Minute))
+
+	checker.Set(testCRDName, true, true)
+
+	exists, established, err := checker.Exists(testCRDName)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !exists || !established {
+		t.Fatalf("Exists() = (%v, %v), want (true, true) as recorded by Set", exists, established)
+	}
+
+	// The fake clientset has no CRD named testCRDName, so if Exists() had bypassed the cache and
+	// queried the API server it would have observed "not found" rather than what Set recorded.
+	for _, action := range client.Fake.Actions() {
+		if action.GetVerb() == "get" {
+			t.Fatalf("Exists() queried the API server (%v) despite a fresh Set()'d cache entry", action)
+		}
+	}
+}
+
+// TestCachedCRDCheckerExistsServesCacheBeforeExpiration ensures Exists() -- the method the real
+// caller (LazyInformer.checkInitialState) relies on -- actually has a cache to serve from, rather
+// than being dead code with no callers.
+func TestCachedCRDCheckerExistsServesCacheBeforeExpiration(t *testing.T) {
+	client := apiextensionsfake.NewSimpleClientset()
+	checker := NewCachedCRDChecker(client, WithExpiration(time.Hour))
+
+	checker.Set(testCRDName, true, true)
+	apiCallsBefore := len(client.Fake.Actions())
+
+	for i := 0; i < 3; i++ {
+		exists, established, err := checker.Exists(testCRDName)
+		if err != nil || !exists || !established {
+			t.Fatalf("Exists() = (%v, %v, %v), want (true, true, nil)", exists, established, err)
+		}
+	}
+
+	if got := len(client.Fake.Actions()); got != apiCallsBefore {
+		t.Fatalf("Exists() issued %d additional API calls while the cache entry was still fresh, want 0", got-apiCallsBefore)
+	}
+}
+
+// TestCachedCRDCheckerForceRefreshBypassesCache ensures ForceRefresh still re-queries the API
+// server even when Set or Exists has already populated a fresh cache entry, for callers that do
+// need to invalidate out-of-band rather than merely record a known value.
+func TestCachedCRDCheckerForceRefreshBypassesCache(t *testing.T) {
+	client := apiextensionsfake.NewSimpleClientset()
+	checker := NewCachedCRDChecker(client, WithExpiration(time.Hour))
+
+	checker.Set(testCRDName, true, true)
+	apiCallsBefore := len(client.Fake.Actions())
+
+	exists, established, err := checker.ForceRefresh(testCRDName)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exists || established {
+		t.Fatalf("ForceRefresh() = (%v, %v), want the freshly-queried (false, false) for a CRD absent from the API server, not Set's stale (true, true)", exists, established)
+	}
+	if got := len(client.Fake.Actions()); got != apiCallsBefore+1 {
+		t.Fatalf("ForceRefresh() issued %d additional API calls, want exactly 1", got-apiCallsBefore)
+	}
+}
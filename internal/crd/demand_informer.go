@@ -16,114 +16,84 @@ package crd
 
 import (
 	"context"
+	"sync"
+	"time"
+
 	demandapi "github.com/palantir/k8s-spark-scheduler-lib/pkg/apis/scaler/v1alpha1"
-	demandclient "github.com/palantir/k8s-spark-scheduler-lib/pkg/client/clientset/versioned/typed/scaler/v1alpha1"
+	scalerclientset "github.com/palantir/k8s-spark-scheduler-lib/pkg/client/clientset/versioned"
 	ssinformers "github.com/palantir/k8s-spark-scheduler-lib/pkg/client/informers/externalversions"
 	"github.com/palantir/k8s-spark-scheduler-lib/pkg/client/informers/externalversions/scaler/v1alpha1"
-	"github.com/palantir/pkg/retry"
-	werror "github.com/palantir/witchcraft-go-error"
-	"github.com/palantir/witchcraft-go-logging/wlog/svclog/svc1log"
 	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
-	clientcache "k8s.io/client-go/tools/cache"
-	"sync"
-	"time"
+	"k8s.io/client-go/tools/cache"
 )
 
 const (
 	informerSyncRetryCount          = 5
 	informerSyncTimeout             = 2 * time.Second
 	informerSyncRetryInitialBackoff = 500 * time.Millisecond
+	crdInformerResync               = 5 * time.Minute
 )
 
-// LazyDemandInformer checks for Demand CRD existence and creates a
-// demand informer if it exists.
+// Event describes a lifecycle transition of an informer managed by a LazyInformer.
+type Event int
+
+const (
+	// EventInformerInitialized is published whenever the underlying informer has been
+	// (re)created and synced.
+	EventInformerInitialized Event = iota
+	// EventInformerStopped is published whenever the underlying informer has been stopped, e.g.
+	// because the backing CRD was deleted or is no longer Established.
+	EventInformerStopped
+)
+
+// LazyDemandInformer checks for Demand CRD existence and creates a demand informer if it exists,
+// tearing it down and re-creating it as the CRD's lifecycle requires. It is a thin typed wrapper
+// around the generic LazyInformer.
 type LazyDemandInformer struct {
-	informerFactory     ssinformers.SharedInformerFactory
-	apiExtensionsClient apiextensionsclientset.Interface
-	demandKubeClient    demandclient.ScalerV1alpha1Interface
-	ready               chan struct{}
-	informer            v1alpha1.DemandInformer
-	lock                sync.RWMutex
+	*LazyInformer
+
+	lock     sync.RWMutex
+	informer v1alpha1.DemandInformer
 }
 
+// NewLazyDemandInformer returns a new LazyDemandInformer. The scalerClient and apiExtensionsClient
+// are used to build a fresh demand informer factory every time the demand CRD transitions to
+// Established.
 func NewLazyDemandInformer(
-	informerFactory ssinformers.SharedInformerFactory,
+	scalerClient scalerclientset.Interface,
 	apiExtensionsClient apiextensionsclientset.Interface,
-	demandKubeClient demandclient.ScalerV1alpha1Interface) *LazyDemandInformer{
-	return &LazyDemandInformer{
-		informerFactory: informerFactory,
-		apiExtensionsClient: apiExtensionsClient,
-		demandKubeClient: demandKubeClient,
-		ready: make(chan struct{}),
+	resync time.Duration) *LazyDemandInformer {
+	ldi := &LazyDemandInformer{}
+
+	// typed accessor closure: captures the typed Demands() handle so it can be threaded back onto
+	// ldi once the generic LazyInformer confirms the informer it wraps has synced.
+	var typed v1alpha1.DemandInformer
+	newInformer := func(ctx context.Context) (cache.SharedIndexInformer, error) {
+		informerFactory := ssinformers.NewSharedInformerFactory(scalerClient, resync)
+		typed = informerFactory.Scaler().V1alpha1().Demands()
+		informerFactory.Start(ctx.Done())
+		return typed.Informer(), nil
 	}
+
+	ldi.LazyInformer = NewLazyInformer(
+		demandapi.DemandCustomResourceDefinitionName(),
+		apiExtensionsClient,
+		newInformer,
+		func() { ldi.setInformer(typed) },
+		func() { ldi.setInformer(nil) },
+	)
+	return ldi
 }
 
-// Informer returns the informer instance if it is initialized, returns nil otherwise
-func(ldi *LazyDemandInformer) Informer() v1alpha1.DemandInformer {
+// Informer returns the demand informer instance if it is initialized, returns nil otherwise
+func (ldi *LazyDemandInformer) Informer() v1alpha1.DemandInformer {
 	ldi.lock.RLock()
 	defer ldi.lock.RUnlock()
 	return ldi.informer
 }
 
-// Ready returns a channel that will be closed when the informer is initialized
-func (ldi *LazyDemandInformer) Ready() <-chan struct{} {
-	return ldi.ready
-}
-
-// Run starts the goroutine to check for the existence of the demand CRD,
-// and initialize the demand informer if CRD exists
-func (ldi *LazyDemandInformer) Run(ctx context.Context) error {
-	t := time.NewTicker(time.Minute)
-	defer t.Stop()
-	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-t.C:
-			if ldi.checkDemandCRDExists(ctx) {
-				return nil
-			}
-		}
-	}
-
-}
-
-func (ldi *LazyDemandInformer) checkDemandCRDExists(ctx context.Context) bool {
-	_, ready, err := CheckCRDExists(demandapi.DemandCustomResourceDefinitionName(), ldi.apiExtensionsClient)
-	if err != nil {
-		svc1log.FromContext(ctx).Info("failed to determine if demand CRD exists", svc1log.Stacktrace(err))
-		return false
-	}
-	if ready {
-		svc1log.FromContext(ctx).Info("demand CRD has been initialized. Demand resources can now be created")
-		err = ldi.initializeInformer(ctx)
-		if err != nil {
-			svc1log.FromContext(ctx).Error("failed initializing demand informer", svc1log.Stacktrace(err))
-			return false
-		}
-	}
-	return ready
-}
-
-func (ldi *LazyDemandInformer) initializeInformer(ctx context.Context) error {
+func (ldi *LazyDemandInformer) setInformer(informer v1alpha1.DemandInformer) {
 	ldi.lock.Lock()
 	defer ldi.lock.Unlock()
-	informerInterface := ldi.informerFactory.Scaler().V1alpha1().Demands()
-	informer := informerInterface.Informer()
-	ldi.informerFactory.Start(ctx.Done())
-
-	err := retry.Do(ctx, func() error {
-		ctxWithTimeout, cancel := context.WithTimeout(ctx, informerSyncTimeout)
-		defer cancel()
-		if ok := clientcache.WaitForCacheSync(ctxWithTimeout.Done(), informer.HasSynced); !ok {
-			return werror.ErrorWithContextParams(ctx,"timeout syncing informer", werror.SafeParam("timeoutSeconds", informerSyncTimeout.Seconds()))
-		}
-		return nil
-	}, retry.WithMaxAttempts(informerSyncRetryCount), retry.WithInitialBackoff(informerSyncRetryInitialBackoff))
-
-	if err != nil {
-		return err
-	}
-	ldi.informer = informerInterface
-	return nil
+	ldi.informer = informer
 }
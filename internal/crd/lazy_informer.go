@@ -0,0 +1,448 @@
+// Copyright (c) 2019 Palantir Technologies. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/palantir/pkg/metrics"
+	"github.com/palantir/pkg/retry"
+	werror "github.com/palantir/witchcraft-go-error"
+	"github.com/palantir/witchcraft-go-logging/wlog/svclog/svc1log"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	apiextensionsinformers "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions"
+	apiextensionsinformersv1 "k8s.io/apiextensions-apiserver/pkg/client/informers/externalversions/apiextensions/v1"
+	clientcache "k8s.io/client-go/tools/cache"
+)
+
+const (
+	metricCRDInitialized  = "crd.lazyinformer.initialized"
+	metricCRDSyncAttempts = "crd.lazyinformer.sync.attempts"
+	metricCRDSyncFailures = "crd.lazyinformer.sync.failures"
+	metricTagCRDName      = "crdName"
+)
+
+// InformerFactory builds, starts and returns the generic clientcache.SharedIndexInformer backing a
+// CRD-derived resource. It is called every time LazyInformer observes the CRD transition to
+// Established, so implementations should construct a fresh informer (and, typically, a fresh
+// informer factory) on every call rather than reusing state across generations.
+type InformerFactory func(ctx context.Context) (clientcache.SharedIndexInformer, error)
+
+// LazyInformer watches a single CRD by name via a shared apiextensions informer, and invokes an
+// InformerFactory once that CRD is Established. If the CRD is later deleted or becomes
+// un-established, the informer is stopped and LazyInformer resumes watching so a subsequent
+// re-creation of the CRD starts a brand-new informer.
+//
+// LazyInformer is generic over the resource behind the CRD; typed wrappers such as
+// LazyDemandInformer thread a closure through the InformerFactory to stash a typed accessor
+// alongside the generic informer it returns.
+type LazyInformer struct {
+	crdName             string
+	apiExtensionsClient apiextensionsclientset.Interface
+	newInformer         InformerFactory
+	onInitialized       func()
+	onStopped           func()
+
+	lock           sync.RWMutex
+	ready          chan struct{}
+	informer       clientcache.SharedIndexInformer
+	cancelInformer context.CancelFunc
+
+	subscriberLock sync.Mutex
+	subscribers    []chan Event
+
+	metrics informerMetrics
+}
+
+type informerMetrics struct {
+	syncAttempts int64
+	syncFailures int64
+}
+
+// NewLazyInformer returns a new LazyInformer for the CRD named crdName. onInitialized and
+// onStopped, if non-nil, are invoked synchronously whenever the informer is (re-)created or torn
+// down, respectively; typed wrappers use these to keep a typed accessor in sync with the generic
+// informer's lifecycle.
+func NewLazyInformer(
+	crdName string,
+	apiExtensionsClient apiextensionsclientset.Interface,
+	newInformer InformerFactory,
+	onInitialized func(),
+	onStopped func()) *LazyInformer {
+	return &LazyInformer{
+		crdName:             crdName,
+		apiExtensionsClient: apiExtensionsClient,
+		newInformer:         newInformer,
+		onInitialized:       onInitialized,
+		onStopped:           onStopped,
+		ready:               make(chan struct{}),
+	}
+}
+
+// Name returns the name of the CRD this LazyInformer watches.
+func (li *LazyInformer) Name() string {
+	return li.crdName
+}
+
+// Ready returns a channel that will be closed when the informer is initialized. Subscribe should
+// be preferred by callers that need to learn about the informer being stopped and re-created.
+func (li *LazyInformer) Ready() <-chan struct{} {
+	li.lock.RLock()
+	defer li.lock.RUnlock()
+	return li.ready
+}
+
+// Subscribe returns a channel on which EventInformerInitialized and EventInformerStopped are
+// published as the informer is created, stopped and re-created. The returned channel is buffered
+// to 1 and coalescing: if the subscriber hasn't drained the previous event by the time a new one is
+// published, the stale event is replaced by the new one rather than dropped in favor of it, so a
+// subscriber that reads at its own pace always eventually observes the most recent transition. The
+// channel is never closed by LazyInformer.
+func (li *LazyInformer) Subscribe() <-chan Event {
+	li.subscriberLock.Lock()
+	defer li.subscriberLock.Unlock()
+	ch := make(chan Event, 1)
+	li.subscribers = append(li.subscribers, ch)
+	return ch
+}
+
+// Run watches the CRD and initializes or tears down the informer as the CRD is created,
+// established, deleted or re-created. Run blocks until ctx is done.
+//
+// Run builds and starts its own apiextensions SharedInformerFactory. Callers managing several
+// LazyInformers should instead register them on a Registry, which shares a single apiextensions
+// informer across all of them rather than opening one LIST+WATCH per CRD.
+func (li *LazyInformer) Run(ctx context.Context) error {
+	crdInformerFactory := apiextensionsinformers.NewSharedInformerFactory(li.apiExtensionsClient, crdInformerResync)
+	crdInformer := crdInformerFactory.Apiextensions().V1().CustomResourceDefinitions()
+	li.registerWithInformer(ctx, crdInformer)
+
+	crdInformerFactory.Start(ctx.Done())
+	clientcache.WaitForCacheSync(ctx.Done(), crdInformer.Informer().HasSynced)
+
+	li.checkInitialState(ctx)
+
+	<-ctx.Done()
+	return nil
+}
+
+// registerWithInformer wires li's Add/Update/Delete handling onto an already-constructed CRD
+// informer, filtered down to li.crdName. It does not start or sync the informer itself, so it is
+// safe to call several times against the same shared informer, once per LazyInformer that wants
+// to watch a (typically different) CRD name through it.
+func (li *LazyInformer) registerWithInformer(ctx context.Context, crdInformer apiextensionsinformersv1.CustomResourceDefinitionInformer) {
+	crdInformer.Informer().AddEventHandler(clientcache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			crd, ok := toCustomResourceDefinition(obj)
+			return ok && crd.Name == li.crdName
+		},
+		Handler: clientcache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				li.handleCRDUpsert(ctx, obj)
+			},
+			UpdateFunc: func(_, newObj interface{}) {
+				li.handleCRDUpsert(ctx, newObj)
+			},
+			DeleteFunc: func(obj interface{}) {
+				li.handleCRDDelete(ctx)
+			},
+		},
+	})
+}
+
+// checkInitialState consults the shared CachedCRDChecker once, after the CRD informer's initial
+// sync, and eagerly initializes the informer if the CRD is already Established. This is a
+// defensive backstop rather than the primary trigger: the initial List underlying the watch above
+// already delivers an Add event (handled by handleCRDUpsert) for a CRD that exists before we start
+// watching, so in the common case this is a cheap, cache-served no-op. It is also the only call
+// site that actually benefits from CachedCRDChecker's TTL: the watch handlers below already know
+// the answer first-hand from the event payload and record it via Set rather than asking again.
+func (li *LazyInformer) checkInitialState(ctx context.Context) {
+	exists, established, err := SharedCRDChecker(li.apiExtensionsClient).Exists(li.crdName)
+	if err != nil {
+		svc1log.FromContext(ctx).Error("failed checking initial CRD state", svc1log.SafeParam("crdName", li.crdName), svc1log.Stacktrace(err))
+		return
+	}
+	if !exists || !established {
+		return
+	}
+	if err := li.initializeInformer(ctx); err != nil {
+		svc1log.FromContext(ctx).Error("failed initializing informer", svc1log.SafeParam("crdName", li.crdName), svc1log.Stacktrace(err))
+	}
+}
+
+func (li *LazyInformer) handleCRDUpsert(ctx context.Context, obj interface{}) {
+	crd, ok := toCustomResourceDefinition(obj)
+	if !ok {
+		return
+	}
+	established := isEstablished(crd)
+	SharedCRDChecker(li.apiExtensionsClient).Set(li.crdName, true, established)
+	if !established {
+		return
+	}
+	svc1log.FromContext(ctx).Info("CRD has been established", svc1log.SafeParam("crdName", li.crdName))
+	if err := li.initializeInformer(ctx); err != nil {
+		svc1log.FromContext(ctx).Error("failed initializing informer", svc1log.SafeParam("crdName", li.crdName), svc1log.Stacktrace(err))
+	}
+}
+
+func (li *LazyInformer) handleCRDDelete(ctx context.Context) {
+	svc1log.FromContext(ctx).Info("CRD has been deleted, stopping informer", svc1log.SafeParam("crdName", li.crdName))
+	SharedCRDChecker(li.apiExtensionsClient).Set(li.crdName, false, false)
+	li.stopInformer(ctx)
+}
+
+func (li *LazyInformer) initializeInformer(ctx context.Context) error {
+	li.lock.Lock()
+	defer li.lock.Unlock()
+	if li.informer != nil {
+		// already initialized for the current generation of the CRD
+		return nil
+	}
+
+	informerCtx, cancel := context.WithCancel(ctx)
+	informer, err := li.newInformer(informerCtx)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	li.recordSyncAttempt(ctx)
+	err = retry.Do(ctx, func() error {
+		ctxWithTimeout, cancelTimeout := context.WithTimeout(ctx, informerSyncTimeout)
+		defer cancelTimeout()
+		if ok := clientcache.WaitForCacheSync(ctxWithTimeout.Done(), informer.HasSynced); !ok {
+			return werror.ErrorWithContextParams(ctx, "timeout syncing informer", werror.SafeParam("crdName", li.crdName), werror.SafeParam("timeoutSeconds", informerSyncTimeout.Seconds()))
+		}
+		return nil
+	}, retry.WithMaxAttempts(informerSyncRetryCount), retry.WithInitialBackoff(informerSyncRetryInitialBackoff))
+
+	if err != nil {
+		li.recordSyncFailure(ctx)
+		cancel()
+		return err
+	}
+
+	li.informer = informer
+	li.cancelInformer = cancel
+	close(li.ready)
+	if li.onInitialized != nil {
+		li.onInitialized()
+	}
+	li.emitGauge(ctx)
+	li.publish(EventInformerInitialized)
+	return nil
+}
+
+func (li *LazyInformer) stopInformer(ctx context.Context) {
+	li.lock.Lock()
+	defer li.lock.Unlock()
+	if li.informer == nil {
+		return
+	}
+	if li.cancelInformer != nil {
+		li.cancelInformer()
+	}
+	li.informer = nil
+	li.cancelInformer = nil
+	li.ready = make(chan struct{})
+	if li.onStopped != nil {
+		li.onStopped()
+	}
+	li.emitGauge(ctx)
+	li.publish(EventInformerStopped)
+}
+
+// emitGauge reports the current initialized state of the informer. It is idempotent and safe to
+// call repeatedly, unlike the sync attempt/failure counters below which must only be incremented
+// once per occurrence.
+func (li *LazyInformer) emitGauge(ctx context.Context) {
+	reporter := metrics.FromContext(ctx)
+	tag, err := metrics.NewTag(metricTagCRDName, li.crdName)
+	if err != nil {
+		return
+	}
+	initialized := int64(0)
+	if li.informer != nil {
+		initialized = 1
+	}
+	reporter.Gauge(metricCRDInitialized, tag).Update(initialized)
+}
+
+// recordSyncAttempt tallies li.metrics.syncAttempts for introspection and reports a single
+// occurrence to the sync-attempts counter. It must be called exactly once per actual attempt;
+// the counter is a running total on the reporter side, so incrementing it by anything other than
+// 1 per occurrence would double-count.
+func (li *LazyInformer) recordSyncAttempt(ctx context.Context) {
+	li.metrics.syncAttempts++
+	if tag, err := metrics.NewTag(metricTagCRDName, li.crdName); err == nil {
+		metrics.FromContext(ctx).Counter(metricCRDSyncAttempts, tag).Inc(1)
+	}
+}
+
+// recordSyncFailure is the recordSyncAttempt counterpart for sync failures.
+func (li *LazyInformer) recordSyncFailure(ctx context.Context) {
+	li.metrics.syncFailures++
+	if tag, err := metrics.NewTag(metricTagCRDName, li.crdName); err == nil {
+		metrics.FromContext(ctx).Counter(metricCRDSyncFailures, tag).Inc(1)
+	}
+}
+
+// publish delivers event to every subscriber's 1-slot channel, coalescing rather than dropping: if
+// a subscriber hasn't yet drained the previous event, that stale event is discarded in favor of the
+// new one rather than leaving the new one unsent. Subscribers are expected to react to a received
+// event by re-querying Informer()/Ready() for the current state rather than treating events as a
+// gapless log, so what matters is that the latest transition is always the one waiting to be read,
+// not that every intermediate transition is individually observed.
+func (li *LazyInformer) publish(event Event) {
+	li.subscriberLock.Lock()
+	defer li.subscriberLock.Unlock()
+	for _, ch := range li.subscribers {
+		select {
+		case ch <- event:
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+			select {
+			case ch <- event:
+			default:
+			}
+		}
+	}
+}
+
+func toCustomResourceDefinition(obj interface{}) (*apiextensionsv1.CustomResourceDefinition, bool) {
+	if crd, ok := obj.(*apiextensionsv1.CustomResourceDefinition); ok {
+		return crd, true
+	}
+	if tombstone, ok := obj.(clientcache.DeletedFinalStateUnknown); ok {
+		crd, ok := tombstone.Obj.(*apiextensionsv1.CustomResourceDefinition)
+		return crd, ok
+	}
+	return nil, false
+}
+
+func isEstablished(crd *apiextensionsv1.CustomResourceDefinition) bool {
+	for _, cond := range crd.Status.Conditions {
+		if cond.Type == apiextensionsv1.Established && cond.Status == apiextensionsv1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// Registry holds an ordered set of LazyInformers so their owners can register every CRD the
+// process cares about in one place and have startup, readiness and lookup handled uniformly.
+type Registry struct {
+	lock      sync.RWMutex
+	order     []string
+	informers map[string]*LazyInformer
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		informers: make(map[string]*LazyInformer),
+	}
+}
+
+// Register adds a LazyInformer to the registry. It panics if a LazyInformer for the same CRD name
+// has already been registered, since that indicates a programming error at startup.
+func (r *Registry) Register(informer *LazyInformer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, exists := r.informers[informer.Name()]; exists {
+		panic("crd: informer already registered for CRD " + informer.Name())
+	}
+	r.informers[informer.Name()] = informer
+	r.order = append(r.order, informer.Name())
+}
+
+// Get returns the LazyInformer registered under name, and whether one was found.
+func (r *Registry) Get(name string) (*LazyInformer, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	informer, ok := r.informers[name]
+	return informer, ok
+}
+
+// Run watches every registered LazyInformer's CRD and blocks until ctx is done. All registered
+// LazyInformers are expected to share the same apiextensions client (the common case: one process
+// talking to one API server), since Run fans every registered CRD name out over a single shared
+// apiextensions informer rather than opening a LIST+WATCH per CRD the way calling Run
+// independently on each LazyInformer would.
+func (r *Registry) Run(ctx context.Context) error {
+	r.lock.RLock()
+	informers := make([]*LazyInformer, 0, len(r.order))
+	for _, name := range r.order {
+		informers = append(informers, r.informers[name])
+	}
+	r.lock.RUnlock()
+
+	if len(informers) == 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	crdInformerFactory := apiextensionsinformers.NewSharedInformerFactory(informers[0].apiExtensionsClient, crdInformerResync)
+	crdInformer := crdInformerFactory.Apiextensions().V1().CustomResourceDefinitions()
+	for _, informer := range informers {
+		informer.registerWithInformer(ctx, crdInformer)
+	}
+
+	crdInformerFactory.Start(ctx.Done())
+	clientcache.WaitForCacheSync(ctx.Done(), crdInformer.Informer().HasSynced)
+
+	for _, informer := range informers {
+		informer.checkInitialState(ctx)
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+// WaitForAll blocks until every registered LazyInformer is ready, or ctx is done, whichever comes
+// first.
+func (r *Registry) WaitForAll(ctx context.Context) error {
+	r.lock.RLock()
+	informers := make([]*LazyInformer, 0, len(r.order))
+	for _, name := range r.order {
+		informers = append(informers, r.informers[name])
+	}
+	r.lock.RUnlock()
+
+	for _, informer := range informers {
+		select {
+		case <-informer.Ready():
+		case <-ctx.Done():
+			return werror.ErrorWithContextParams(ctx, "context done while waiting for CRD informers", werror.SafeParam("crdName", informer.Name()))
+		}
+	}
+	return nil
+}
+
+// WaitTimeout is a convenience helper for callers that want to bound WaitForAll with a timeout
+// rather than threading a cancellable context through their startup code.
+func (r *Registry) WaitTimeout(ctx context.Context, timeout time.Duration) error {
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return r.WaitForAll(ctxWithTimeout)
+}
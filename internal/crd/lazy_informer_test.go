@@ -0,0 +1,211 @@
+// Copyright (c) 2019 Palantir Technologies. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package crd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/palantir/pkg/metrics"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coreinformers "k8s.io/client-go/informers"
+	corefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+const testCRDName = "widgets.example.com"
+
+func establishedCRD(name string) *apiextensionsv1.CustomResourceDefinition {
+	return &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: apiextensionsv1.CustomResourceDefinitionStatus{
+			Conditions: []apiextensionsv1.CustomResourceDefinitionCondition{
+				{Type: apiextensionsv1.Established, Status: apiextensionsv1.ConditionTrue},
+			},
+		},
+	}
+}
+
+// newTestLazyInformer returns a LazyInformer whose InformerFactory builds a trivial, fast-syncing
+// informer (over an unrelated Pod fake clientset) every time it's invoked, so each call represents
+// a fresh "generation" the way a real resync after CRD re-creation would.
+func newTestLazyInformer(apiExtensionsClient *apiextensionsfake.Clientset) *LazyInformer {
+	return NewLazyInformer(testCRDName, apiExtensionsClient, func(ctx context.Context) (cache.SharedIndexInformer, error) {
+		factory := coreinformers.NewSharedInformerFactory(corefake.NewSimpleClientset(), 0)
+		informer := factory.Core().V1().Pods().Informer()
+		factory.Start(ctx.Done())
+		return informer, nil
+	}, nil, nil)
+}
+
+func waitForClosed(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func waitForEvent(t *testing.T, ch <-chan Event, want Event, what string) {
+	t.Helper()
+	select {
+	case got := <-ch:
+		if got != want {
+			t.Fatalf("got event %v, want %v (%s)", got, want, what)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+// resetSharedCRDChecker clears the process-wide CachedCRDChecker singleton so tests that exercise
+// LazyInformer's use of it (directly or via Run/Registry.Run's checkInitialState) don't observe
+// cached results left behind by another test reusing the same CRD name.
+func resetSharedCRDChecker(t *testing.T) {
+	t.Helper()
+	clear := func() {
+		sharedCRDCheckerLock.Lock()
+		defer sharedCRDCheckerLock.Unlock()
+		sharedCRDChecker = nil
+	}
+	clear()
+	t.Cleanup(clear)
+}
+
+// TestLazyInformerLifecycle exercises the established -> deleted -> re-established transition:
+// the informer should initialize on first establishment, tear down and reset Ready on deletion,
+// and initialize again as a fresh generation once the CRD is re-created.
+func TestLazyInformerLifecycle(t *testing.T) {
+	resetSharedCRDChecker(t)
+	apiExtensionsClient := apiextensionsfake.NewSimpleClientset()
+	li := newTestLazyInformer(apiExtensionsClient)
+	events := li.Subscribe()
+
+	ctx, cancel := context.WithCancel(metrics.WithRegistry(context.Background(), metrics.NewRootMetricsRegistry()))
+	defer cancel()
+	go func() { _ = li.Run(ctx) }()
+
+	firstReady := li.Ready()
+
+	if _, err := apiExtensionsClient.ApiextensionsV1().CustomResourceDefinitions().Create(ctx, establishedCRD(testCRDName), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("creating CRD: %v", err)
+	}
+	waitForEvent(t, events, EventInformerInitialized, "initial establishment")
+	waitForClosed(t, firstReady, "first Ready()")
+
+	if err := apiExtensionsClient.ApiextensionsV1().CustomResourceDefinitions().Delete(ctx, testCRDName, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("deleting CRD: %v", err)
+	}
+	waitForEvent(t, events, EventInformerStopped, "deletion")
+
+	select {
+	case <-li.Ready():
+		t.Fatal("Ready() still reports ready after CRD deletion")
+	default:
+	}
+
+	secondReady := li.Ready()
+	if secondReady == firstReady {
+		t.Fatal("Ready() channel was not replaced after the informer was stopped")
+	}
+
+	if _, err := apiExtensionsClient.ApiextensionsV1().CustomResourceDefinitions().Create(ctx, establishedCRD(testCRDName), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("re-creating CRD: %v", err)
+	}
+	waitForEvent(t, events, EventInformerInitialized, "re-establishment")
+	waitForClosed(t, secondReady, "second Ready()")
+
+	tag, err := metrics.NewTag(metricTagCRDName, testCRDName)
+	if err != nil {
+		t.Fatalf("building metrics tag: %v", err)
+	}
+	if got := metrics.FromContext(ctx).Counter(metricCRDSyncAttempts, tag).Count(); got != 2 {
+		t.Fatalf("sync attempts counter = %d, want 2 (one per generation, not a running total re-reported on every event)", got)
+	}
+	if got := metrics.FromContext(ctx).Counter(metricCRDSyncFailures, tag).Count(); got != 0 {
+		t.Fatalf("sync failures counter = %d, want 0", got)
+	}
+}
+
+// TestPublishCoalescesUnreadEvents is the regression test for a quick Established -> Deleted ->
+// Established flap (e.g. a CRD reapplied mid Helm-upgrade) while a subscriber hasn't yet drained its
+// channel: the subscriber must still end up observing EventInformerStopped rather than missing it
+// because EventInformerInitialized was still sitting unread in the 1-slot buffer.
+func TestPublishCoalescesUnreadEvents(t *testing.T) {
+	li := &LazyInformer{}
+	events := li.Subscribe()
+
+	li.publish(EventInformerInitialized)
+	li.publish(EventInformerStopped)
+	li.publish(EventInformerInitialized)
+
+	select {
+	case got := <-events:
+		if got != EventInformerInitialized {
+			t.Fatalf("got event %v, want the latest published event EventInformerInitialized", got)
+		}
+	default:
+		t.Fatal("publish dropped all three events instead of coalescing onto the latest one")
+	}
+
+	select {
+	case got := <-events:
+		t.Fatalf("got unexpected second event %v; publish should coalesce onto a single slot, not queue", got)
+	default:
+	}
+}
+
+// TestRegistryRunSharesSingleInformer ensures that registering several CRDs with a Registry fans
+// them out over one apiextensions informer rather than opening a LIST+WATCH per CRD.
+func TestRegistryRunSharesSingleInformer(t *testing.T) {
+	resetSharedCRDChecker(t)
+	apiExtensionsClient := apiextensionsfake.NewSimpleClientset()
+	registry := NewRegistry()
+	first := newTestLazyInformer(apiExtensionsClient)
+	second := NewLazyInformer("gadgets.example.com", apiExtensionsClient, first.newInformer, nil, nil)
+	registry.Register(first)
+	registry.Register(second)
+
+	ctx, cancel := context.WithCancel(metrics.WithRegistry(context.Background(), metrics.NewRootMetricsRegistry()))
+	defer cancel()
+	go func() { _ = registry.Run(ctx) }()
+
+	if _, err := apiExtensionsClient.ApiextensionsV1().CustomResourceDefinitions().Create(ctx, establishedCRD(testCRDName), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("creating CRD: %v", err)
+	}
+	waitForClosed(t, first.Ready(), "first registered CRD")
+
+	if _, err := apiExtensionsClient.ApiextensionsV1().CustomResourceDefinitions().Create(ctx, establishedCRD("gadgets.example.com"), metav1.CreateOptions{}); err != nil {
+		t.Fatalf("creating second CRD: %v", err)
+	}
+	waitForClosed(t, second.Ready(), "second registered CRD")
+
+	// Registry.Run is expected to fan both CRD names out over one shared CustomResourceDefinitions
+	// watch rather than opening one per registered LazyInformer, the way calling Run independently
+	// on each would. A "watch" action is only ever issued once per underlying informer.
+	watchCount := 0
+	for _, action := range apiExtensionsClient.Fake.Actions() {
+		if action.GetVerb() == "watch" && action.GetResource().Resource == "customresourcedefinitions" {
+			watchCount++
+		}
+	}
+	if watchCount != 1 {
+		t.Fatalf("observed %d CustomResourceDefinitions watches, want exactly 1 shared across both registered LazyInformers", watchCount)
+	}
+}
@@ -16,36 +16,218 @@ package extender
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	"github.com/palantir/k8s-spark-scheduler/internal/cache"
 	"github.com/palantir/k8s-spark-scheduler/internal/common/utils"
+	"github.com/palantir/pkg/metrics"
+	"github.com/palantir/witchcraft-go-logging/wlog/svclog/svc1log"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 	coreinformers "k8s.io/client-go/informers/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	clientcache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 )
 
-// DemandGC is a background pod event handler which deletes any demand we have previously created for a pod when a pod gets scheduled.
-// We also delete demands elsewhere in the extender when we schedule the pod, but those can miss some demands due to race conditions.
+const (
+	metricDemandGCDeleted           = "demandgc.deleted"
+	metricDemandGCErrors            = "demandgc.errors"
+	metricDemandGCOrphansReconciled = "demandgc.orphans.reconciled"
+
+	// DefaultDemandGCWorkers is the number of worker goroutines DemandGC starts when the extender
+	// config does not override it.
+	DefaultDemandGCWorkers = 2
+	// DefaultDemandGCOrphanGracePeriod is how long a demand is left alone after its owning pod
+	// disappears before DemandGC assumes the pod-scheduled/pod-deleted events were missed and
+	// reconciles it, when the extender config does not override it.
+	DefaultDemandGCOrphanGracePeriod = 10 * time.Minute
+
+	demandGCReconcileInterval = time.Minute
+)
+
+// DemandGC is a background pod event handler which deletes any demand we have previously created
+// for a pod once the pod no longer needs it: because it was scheduled, or because it was removed
+// before we ever saw it scheduled (e.g. a failed pod). We also delete demands elsewhere in the
+// extender when we schedule the pod, but those can miss some demands due to race conditions.
+//
+// Deletions are driven through a rate-limited work queue rather than performed synchronously from
+// the informer callback, so a transient API error or a not-yet-populated demand cache no longer
+// silently drops the cleanup: failures are retried with backoff. A periodic reconcile additionally
+// lists demands whose owning pod has actually been observed missing for longer than gracePeriod
+// and enqueues them, to catch demands orphaned by missed events, e.g. informer downtime during a
+// scheduler restart.
 type DemandGC struct {
 	demandCache *cache.SafeDemandCache
-	ctx         context.Context
+	podLister   corelisters.PodLister
+	queue       workqueue.RateLimitingInterface
+	workers     int
+	gracePeriod time.Duration
+
+	missingLock  sync.Mutex
+	missingSince map[types.NamespacedName]time.Time
 }
 
-// StartDemandGC initializes the DemandGC which handles events in the background
-func StartDemandGC(ctx context.Context, podInformer coreinformers.PodInformer, demandCache *cache.SafeDemandCache) {
+// StartDemandGC initializes the DemandGC which handles events in the background. workers and
+// gracePeriod are sourced from the extender config; non-positive values fall back to
+// DefaultDemandGCWorkers and DefaultDemandGCOrphanGracePeriod respectively.
+func StartDemandGC(
+	ctx context.Context,
+	podInformer coreinformers.PodInformer,
+	demandCache *cache.SafeDemandCache,
+	workers int,
+	gracePeriod time.Duration) *DemandGC {
+	if workers <= 0 {
+		workers = DefaultDemandGCWorkers
+	}
+	if gracePeriod <= 0 {
+		gracePeriod = DefaultDemandGCOrphanGracePeriod
+	}
+
 	dgc := &DemandGC{
-		demandCache: demandCache,
-		ctx:         ctx,
+		demandCache:  demandCache,
+		podLister:    podInformer.Lister(),
+		queue:        workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		workers:      workers,
+		gracePeriod:  gracePeriod,
+		missingSince: make(map[types.NamespacedName]time.Time),
 	}
 
 	podInformer.Informer().AddEventHandler(
 		clientcache.FilteringResourceEventHandler{
 			FilterFunc: utils.IsSparkSchedulerPod,
 			Handler: clientcache.ResourceEventHandlerFuncs{
-				UpdateFunc: utils.OnPodScheduled(ctx, func(pod *v1.Pod) {
-					DeleteDemandIfExists(dgc.ctx, dgc.demandCache, pod, "DemandGC")
-				}),
+				UpdateFunc: utils.OnPodScheduled(ctx, dgc.enqueuePod),
+				DeleteFunc: func(obj interface{}) {
+					if pod, ok := toPod(obj); ok {
+						dgc.enqueuePod(pod)
+					}
+				},
 			},
 		},
 	)
+
+	go dgc.run(ctx)
+	go dgc.reconcileLoop(ctx)
+
+	return dgc
+}
+
+func (dgc *DemandGC) enqueuePod(pod *v1.Pod) {
+	dgc.queue.Add(types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name})
+}
+
+func (dgc *DemandGC) run(ctx context.Context) {
+	defer dgc.queue.ShutDown()
+	for i := 0; i < dgc.workers; i++ {
+		go dgc.runWorker(ctx)
+	}
+	<-ctx.Done()
+}
+
+func (dgc *DemandGC) runWorker(ctx context.Context) {
+	for dgc.processNextItem(ctx) {
+	}
+}
+
+func (dgc *DemandGC) processNextItem(ctx context.Context) bool {
+	key, shutdown := dgc.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer dgc.queue.Done(key)
+
+	namespacedName := key.(types.NamespacedName)
+	pod := &v1.Pod{}
+	pod.Namespace = namespacedName.Namespace
+	pod.Name = namespacedName.Name
+
+	if err := DeleteDemandIfExists(ctx, dgc.demandCache, pod, "DemandGC"); err != nil {
+		svc1log.FromContext(ctx).Error("failed deleting demand, will retry", svc1log.SafeParam("pod", namespacedName.String()), svc1log.Stacktrace(err))
+		metrics.FromContext(ctx).Counter(metricDemandGCErrors).Inc(1)
+		dgc.queue.AddRateLimited(key)
+		return true
+	}
+
+	metrics.FromContext(ctx).Counter(metricDemandGCDeleted).Inc(1)
+	dgc.queue.Forget(key)
+	return true
+}
+
+// reconcileLoop periodically sweeps the demand cache for demands orphaned by missed pod events.
+func (dgc *DemandGC) reconcileLoop(ctx context.Context) {
+	ticker := time.NewTicker(demandGCReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			dgc.reconcileOrphans(ctx)
+		}
+	}
+}
+
+// reconcileOrphans gates on how long each demand's owning pod has actually been missing from the
+// pod lister, not on the demand's own CreationTimestamp: a demand is normally created well before
+// its pod completes, so creation time is almost always already older than gracePeriod by the time
+// the pod is actually gone, which would fire immediately instead of waiting out the grace period.
+// That races the normal delete-event path and misfires for pods that simply haven't synced into
+// the pod lister yet, e.g. right after a scheduler restart -- exactly the informer-downtime case
+// this reconcile is meant to backstop rather than preempt.
+func (dgc *DemandGC) reconcileOrphans(ctx context.Context) {
+	missing := make(map[types.NamespacedName]bool)
+	for _, demand := range dgc.demandCache.List() {
+		key := types.NamespacedName{Namespace: demand.Namespace, Name: demand.Name}
+		if _, err := dgc.podLister.Pods(demand.Namespace).Get(demand.Name); err == nil {
+			// owning pod still exists, nothing to do yet
+			continue
+		}
+		missing[key] = true
+		missingSince := dgc.recordMissingSince(key)
+		if time.Since(missingSince) < dgc.gracePeriod {
+			continue
+		}
+		metrics.FromContext(ctx).Counter(metricDemandGCOrphansReconciled).Inc(1)
+		dgc.queue.Add(key)
+	}
+	dgc.forgetMissingExcept(missing)
+}
+
+// recordMissingSince returns the first time reconcileOrphans observed key's owning pod missing,
+// recording the current time the first time key is seen.
+func (dgc *DemandGC) recordMissingSince(key types.NamespacedName) time.Time {
+	dgc.missingLock.Lock()
+	defer dgc.missingLock.Unlock()
+	if since, ok := dgc.missingSince[key]; ok {
+		return since
+	}
+	since := time.Now()
+	dgc.missingSince[key] = since
+	return since
+}
+
+// forgetMissingExcept drops tracked missing-since timestamps for any key not in stillMissing, i.e.
+// demands whose pod reappeared or that are no longer in the demand cache (deleted via the normal
+// event-driven path, or by this same reconcile), so the map doesn't grow unbounded.
+func (dgc *DemandGC) forgetMissingExcept(stillMissing map[types.NamespacedName]bool) {
+	dgc.missingLock.Lock()
+	defer dgc.missingLock.Unlock()
+	for key := range dgc.missingSince {
+		if !stillMissing[key] {
+			delete(dgc.missingSince, key)
+		}
+	}
+}
+
+func toPod(obj interface{}) (*v1.Pod, bool) {
+	if pod, ok := obj.(*v1.Pod); ok {
+		return pod, true
+	}
+	if tombstone, ok := obj.(clientcache.DeletedFinalStateUnknown); ok {
+		pod, ok := tombstone.Obj.(*v1.Pod)
+		return pod, ok
+	}
+	return nil, false
 }
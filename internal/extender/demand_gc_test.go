@@ -0,0 +1,76 @@
+// Copyright (c) 2019 Palantir Technologies. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extender
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestRecordMissingSincePinsFirstObservation(t *testing.T) {
+	dgc := &DemandGC{missingSince: make(map[types.NamespacedName]time.Time)}
+	key := types.NamespacedName{Namespace: "ns", Name: "demand-a"}
+
+	first := dgc.recordMissingSince(key)
+	time.Sleep(time.Millisecond)
+	second := dgc.recordMissingSince(key)
+
+	if !first.Equal(second) {
+		t.Fatalf("recordMissingSince should pin the first-observed time, got %v then %v", first, second)
+	}
+}
+
+func TestForgetMissingExceptPrunesReappearedDemands(t *testing.T) {
+	dgc := &DemandGC{missingSince: make(map[types.NamespacedName]time.Time)}
+	stillMissing := types.NamespacedName{Namespace: "ns", Name: "still-missing"}
+	reappeared := types.NamespacedName{Namespace: "ns", Name: "reappeared"}
+
+	dgc.recordMissingSince(stillMissing)
+	dgc.recordMissingSince(reappeared)
+
+	dgc.forgetMissingExcept(map[types.NamespacedName]bool{stillMissing: true})
+
+	if _, ok := dgc.missingSince[reappeared]; ok {
+		t.Fatal("forgetMissingExcept should have dropped a demand no longer reported missing")
+	}
+	if _, ok := dgc.missingSince[stillMissing]; !ok {
+		t.Fatal("forgetMissingExcept should keep tracking a demand that is still missing")
+	}
+}
+
+// TestReconcileOrphansGracePeriodGatesOnFirstObservedMissing is a regression test for the
+// grace-period bug itself: gating on demand.CreationTimestamp would enqueue on the very first
+// reconcile pass after a pod goes missing, since demands are normally created well before
+// gracePeriod has elapsed since their own creation. Gating must instead be pinned to the first
+// time the owning pod was observed missing, so a second reconcile pass moments later must not
+// reset the clock and must still be within the grace period.
+func TestReconcileOrphansGracePeriodGatesOnFirstObservedMissing(t *testing.T) {
+	dgc := &DemandGC{
+		gracePeriod:  time.Hour,
+		missingSince: make(map[types.NamespacedName]time.Time),
+	}
+	key := types.NamespacedName{Namespace: "ns", Name: "demand-a"}
+
+	missingSince := dgc.recordMissingSince(key)
+	if time.Since(missingSince) >= dgc.gracePeriod {
+		t.Fatal("test setup invalid: missingSince should be recorded as now")
+	}
+
+	if got := dgc.recordMissingSince(key); !got.Equal(missingSince) {
+		t.Fatal("a second reconcile pass must not reset the missing-since clock")
+	}
+}